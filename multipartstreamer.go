@@ -1,30 +1,46 @@
 /*
 Package multipartstreamer helps you encode large files in MIME multipart format
 without reading the entire content into memory.  It uses io.MultiReader to
-combine an inner multipart.Reader with a file handle.
+stitch together any number of streamed parts, in order, without buffering
+their bodies.
 */
 package multipartstreamer
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"mime/multipart"
+	"mime/quotedprintable"
 	"net/http"
 	"net/textproto"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 )
 
+// segment is one piece of the streamed body: either a snapshot of header
+// bytes flushed from bodyBuffer, or a part's body reader, whose length is -1
+// when unknown.
+type segment struct {
+	reader io.Reader
+	length int64
+}
+
 type MultipartStreamer struct {
-	ContentType   string
-	bodyBuffer    *bytes.Buffer
-	bodyWriter    *multipart.Writer
-	closeBuffer   *bytes.Buffer
-	reader        io.Reader
-	contentLength int64
+	ContentType string
+	bodyBuffer  *bytes.Buffer
+	bodyWriter  *multipart.Writer
+	closeBuffer *bytes.Buffer
+	segments    []segment
+
+	baseContentType string
+	form            bool
 }
 
 type MSOption func(ms *MultipartStreamer)
@@ -35,9 +51,18 @@ func WithBoundary(b string) MSOption {
 	}
 }
 
+// WithContentType overrides the top-level Content-Type (normally
+// "multipart/form-data"), e.g. to "multipart/mixed" for a container that
+// isn't a form submission. The boundary parameter is still appended by New.
+func WithContentType(contentType string) MSOption {
+	return func(ms *MultipartStreamer) {
+		ms.baseContentType = contentType
+	}
+}
+
 // New initializes a new MultipartStreamer.
 func New(opts ...MSOption) (m *MultipartStreamer) {
-	m = &MultipartStreamer{bodyBuffer: new(bytes.Buffer)}
+	m = &MultipartStreamer{bodyBuffer: new(bytes.Buffer), baseContentType: "multipart/form-data", form: true}
 	m.bodyWriter = multipart.NewWriter(m.bodyBuffer)
 
 	for _, fopt := range opts {
@@ -45,7 +70,7 @@ func New(opts ...MSOption) (m *MultipartStreamer) {
 	}
 
 	boundary := m.bodyWriter.Boundary()
-	m.ContentType = "multipart/form-data; boundary=" + boundary
+	m.ContentType = m.baseContentType + "; boundary=" + boundary
 
 	closeBoundary := fmt.Sprintf("\r\n--%s--\r\n", boundary)
 	m.closeBuffer = bytes.NewBufferString(closeBoundary)
@@ -53,6 +78,16 @@ func New(opts ...MSOption) (m *MultipartStreamer) {
 	return
 }
 
+// newDirStreamer builds the nested MultipartStreamer used for a directory's
+// children: multipart/mixed instead of form-data, with "file" (not
+// "form-data") part dispositions since these parts are no longer form
+// fields.
+func newDirStreamer() *MultipartStreamer {
+	m := New(WithContentType("multipart/mixed"))
+	m.form = false
+	return m
+}
+
 // WriteFields writes multiple form fields to the multipart.Writer.
 func (m *MultipartStreamer) WriteFields(fields map[string]string) error {
 	var err error
@@ -70,11 +105,13 @@ func (m *MultipartStreamer) WriteFields(fields map[string]string) error {
 // WriteReader adds an io.Reader to get the content of a file.
 // The reader is not accessed until the multipart.Reader is copied to some output writer.
 func (m *MultipartStreamer) WriteReader(key, filename string, size int64, reader io.Reader) (err error) {
-	m.reader = reader
-	m.contentLength = size
+	if _, err = m.bodyWriter.CreateFormFile(key, filename); err != nil {
+		return err
+	}
 
-	_, err = m.bodyWriter.CreateFormFile(key, filename)
-	return
+	m.flushBuffer()
+	m.segments = append(m.segments, segment{reader: reader, length: size})
+	return nil
 }
 
 // WriteReaderWithSize adds an io.Reader to get the content of a file.
@@ -89,17 +126,206 @@ func (m *MultipartStreamer) WriteReaderWithSize(key, filename string, size int64
 // WriteReaderWithHeaders adds an io.Reader to get the content of a file.
 // The reader is not accessed until the multipart.Reader is copied to some output writer.
 func (m *MultipartStreamer) WriteReaderWithHeaders(key, filename string, reader io.Reader, headers map[string]any) (err error) {
-	m.reader = reader
-	m.contentLength = (headers["Content-Length"].(int64))
+	size := headers["Content-Length"].(int64)
 
 	h := make(textproto.MIMEHeader)
-	h.Set("Content-Disposition",
-		fmt.Sprintf(`form-data; name="%s"; filename="%s"`, escapeQuotes(key), escapeQuotes(filename)))
+	h.Set("Content-Disposition", m.dispositionHeader(key, filename))
 	for k, v := range headers {
+		if k == "Content-Length" && size < 0 {
+			continue // unknown size: nothing meaningful to put on the wire
+		}
 		h.Set(k, fmt.Sprintf("%v", v))
 	}
-	_, err = m.bodyWriter.CreatePart(h)
-	return
+	return m.writeStreamPart(h, reader, size)
+}
+
+// WriteReaderUnknownSize adds an io.Reader of unknown length as a part's
+// body, e.g. a pipe, a compressed stream, or an HTTP response body. The
+// part's Content-Length is omitted, and Len() for the whole streamer
+// reports -1; SetupRequest copies that into req.ContentLength so net/http
+// falls back to "Transfer-Encoding: chunked" instead of requiring a size
+// upfront.
+func (m *MultipartStreamer) WriteReaderUnknownSize(key, filename string, reader io.Reader) error {
+	return m.WriteReaderWithHeaders(key, filename, reader, map[string]any{
+		"Content-Type":   "application/octet-stream",
+		"Content-Length": int64(-1),
+	})
+}
+
+// dispositionHeader builds the Content-Disposition value for a part's
+// filename. Top-level streamers use "form-data" (so parts behave like form
+// fields); nested directory streamers use "file" since their parts aren't
+// form fields at all.
+func (m *MultipartStreamer) dispositionHeader(key, filename string) string {
+	if m.form {
+		return fmt.Sprintf(`form-data; name="%s"; filename="%s"`, escapeQuotes(key), escapeQuotes(filename))
+	}
+	return fmt.Sprintf(`file; filename="%s"`, escapeQuotes(filename))
+}
+
+// writeStreamPart creates a part with the given headers, then enqueues
+// reader as that part's body segment.
+func (m *MultipartStreamer) writeStreamPart(h textproto.MIMEHeader, reader io.Reader, size int64) error {
+	if _, err := m.bodyWriter.CreatePart(h); err != nil {
+		return err
+	}
+
+	m.flushBuffer()
+	m.segments = append(m.segments, segment{reader: reader, length: size})
+	return nil
+}
+
+// TransferEncoding selects how WritePartEncoded encodes a part's body.
+type TransferEncoding string
+
+const (
+	EncodingIdentity        TransferEncoding = "identity"
+	EncodingGzip            TransferEncoding = "gzip"
+	EncodingBase64          TransferEncoding = "base64"
+	EncodingQuotedPrintable TransferEncoding = "quoted-printable"
+)
+
+// WritePartEncoded adds reader as a part's body, transfer-encoding it with
+// encoding and setting the matching Content-Transfer-Encoding or
+// Content-Encoding header. The encoder wraps reader lazily: nothing is read
+// until the part's turn comes up while GetReader is being consumed.
+//
+// EncodingIdentity and EncodingBase64 have a deterministic output size
+// (base64 inflates size bytes to exactly 4*ceil(size/3)), so Len() stays
+// exact. EncodingGzip and EncodingQuotedPrintable don't: pass precompute to
+// run the encoder into a temporary file up front and measure the real
+// length; otherwise the part's length is unknown and Len() reports -1 for
+// the whole body, same as WriteReaderUnknownSize.
+func (m *MultipartStreamer) WritePartEncoded(key, filename string, size int64, reader io.Reader, encoding TransferEncoding, precompute bool, headers map[string]any) error {
+	if headers == nil {
+		headers = map[string]any{}
+	}
+	if hk, hv := encoding.header(); hk != "" {
+		headers[hk] = hv
+	}
+
+	switch encoding {
+	case EncodingIdentity, "":
+		headers["Content-Length"] = size
+		return m.WriteReaderWithHeaders(key, filename, reader, headers)
+
+	case EncodingBase64:
+		headers["Content-Length"] = base64EncodedLen(size)
+		return m.WriteReaderWithHeaders(key, filename, newLazyEncodedReader(reader, base64Encoder), headers)
+
+	case EncodingGzip, EncodingQuotedPrintable:
+		newEncoder := gzipEncoder
+		if encoding == EncodingQuotedPrintable {
+			newEncoder = quotedPrintableEncoder
+		}
+
+		if !precompute {
+			headers["Content-Length"] = int64(-1)
+			return m.WriteReaderWithHeaders(key, filename, newLazyEncodedReader(reader, newEncoder), headers)
+		}
+
+		encoded, encodedSize, err := precomputeEncoded(reader, newEncoder)
+		if err != nil {
+			return err
+		}
+		headers["Content-Length"] = encodedSize
+		return m.WriteReaderWithHeaders(key, filename, encoded, headers)
+
+	default:
+		return fmt.Errorf("multipartstreamer: unknown transfer encoding %q", encoding)
+	}
+}
+
+// header returns the Content-Transfer-Encoding or Content-Encoding header
+// to set for this encoding, or ("", "") for identity.
+func (e TransferEncoding) header() (key, value string) {
+	switch e {
+	case EncodingGzip:
+		return "Content-Encoding", "gzip"
+	case EncodingBase64:
+		return "Content-Transfer-Encoding", "base64"
+	case EncodingQuotedPrintable:
+		return "Content-Transfer-Encoding", "quoted-printable"
+	default:
+		return "", ""
+	}
+}
+
+// base64EncodedLen returns the exact size of n bytes encoded with
+// base64.StdEncoding (no line breaks): 4*ceil(n/3).
+func base64EncodedLen(n int64) int64 {
+	return ((n + 2) / 3) * 4
+}
+
+func base64Encoder(w io.Writer) io.WriteCloser {
+	return base64.NewEncoder(base64.StdEncoding, w)
+}
+
+func gzipEncoder(w io.Writer) io.WriteCloser {
+	return gzip.NewWriter(w)
+}
+
+func quotedPrintableEncoder(w io.Writer) io.WriteCloser {
+	return quotedprintable.NewWriter(w)
+}
+
+// lazyEncodedReader pipes src through an encoder, but doesn't start doing so
+// until the first Read, so wrapping a reader in encoding never triggers any
+// I/O on its own.
+type lazyEncodedReader struct {
+	once       sync.Once
+	pr         *io.PipeReader
+	pw         *io.PipeWriter
+	src        io.Reader
+	newEncoder func(io.Writer) io.WriteCloser
+}
+
+func newLazyEncodedReader(src io.Reader, newEncoder func(io.Writer) io.WriteCloser) *lazyEncodedReader {
+	pr, pw := io.Pipe()
+	return &lazyEncodedReader{pr: pr, pw: pw, src: src, newEncoder: newEncoder}
+}
+
+func (r *lazyEncodedReader) Read(p []byte) (int, error) {
+	r.once.Do(func() {
+		go func() {
+			enc := r.newEncoder(r.pw)
+			_, err := io.Copy(enc, r.src)
+			if closeErr := enc.Close(); err == nil {
+				err = closeErr
+			}
+			r.pw.CloseWithError(err)
+		}()
+	})
+	return r.pr.Read(p)
+}
+
+// precomputeEncoded runs src through newEncoder into a temporary file right
+// away, so the exact encoded length is known up front, and returns a reader
+// positioned at its start.
+func precomputeEncoded(src io.Reader, newEncoder func(io.Writer) io.WriteCloser) (io.Reader, int64, error) {
+	tmp, err := ioutil.TempFile("", "multipartstreamer-")
+	if err != nil {
+		return nil, 0, err
+	}
+	os.Remove(tmp.Name())
+
+	enc := newEncoder(tmp)
+	if _, err := io.Copy(enc, src); err != nil {
+		return nil, 0, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, 0, err
+	}
+
+	info, err := tmp.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+
+	return tmp, info.Size(), nil
 }
 
 // WriteFile is a shortcut for adding a local file as an io.Reader.
@@ -117,31 +343,98 @@ func (m *MultipartStreamer) WriteFile(key, filename string) error {
 	return m.WriteReader(key, filepath.Base(filename), stat.Size(), fh)
 }
 
+// WriteDirectory walks the filesystem tree rooted at root and adds it as a
+// single part named key. Regular files become their own streamed parts;
+// subdirectories become parts whose Content-Type is "multipart/mixed" and
+// whose body is a nested multipart stream of their children, recursively.
+// Every part carries an "Abspath" header with its path relative to root.
+func (m *MultipartStreamer) WriteDirectory(key, root string) error {
+	return m.writeTreeEntry(key, root, root)
+}
+
+// writeTreeEntry adds the file or directory at path (relative to root) as a
+// part named key.
+func (m *MultipartStreamer) writeTreeEntry(key, path, root string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return err
+	}
+
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", m.dispositionHeader(key, filepath.Base(path)))
+	h.Set("Abspath", rel)
+
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return err
+		}
+
+		dir := newDirStreamer()
+		for _, entry := range entries {
+			if err := dir.writeTreeEntry(entry.Name(), filepath.Join(path, entry.Name()), root); err != nil {
+				return err
+			}
+		}
+
+		h.Set("Content-Type", dir.ContentType)
+		return m.writeStreamPart(h, dir.GetReader(), dir.Len())
+	}
+
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("multipartstreamer: %s is not a regular file or directory", path)
+	}
+
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	h.Set("Content-Type", "application/octet-stream")
+	return m.writeStreamPart(h, fh, info.Size())
+}
+
 var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
 
 func escapeQuotes(s string) string {
 	return quoteEscaper.Replace(s)
 }
 
-// WritePart writes a multipart "part" with specified headers and content
+// WritePart adds a multipart "part" with the given headers and content.
+// Like WriteReader, data is not read until the multipart.Reader is copied
+// to some output writer; its length is treated as unknown (see
+// WriteReaderUnknownSize), so Len() for the whole streamer reports -1
+// unless the caller already knows data's size and sets a Content-Length
+// header.
 func (m *MultipartStreamer) WritePart(fieldname string, data io.Reader, headers map[string]string) error {
 	h := make(textproto.MIMEHeader)
 	h.Set("Content-Disposition",
 		fmt.Sprintf(`form-data; name="%s"`, escapeQuotes(fieldname)))
+
+	size := int64(-1)
 	for k, v := range headers {
+		if k == "Content-Length" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return fmt.Errorf("multipartstreamer: invalid Content-Length %q: %w", v, err)
+			}
+			size = n
+		}
 		h.Set(k, v)
 	}
 
-	part, err := m.bodyWriter.CreatePart(h)
-	if err != nil {
-		return err
-	}
-
-	_, err = io.Copy(part, data)
-	return err
+	return m.writeStreamPart(h, data, size)
 }
 
 // SetupRequest sets up the http.Request body, and some crucial HTTP headers.
+// If any part has an unknown length, Len() (and so req.ContentLength) is
+// -1, which tells net/http to omit Content-Length and use
+// "Transfer-Encoding: chunked" instead.
 func (m *MultipartStreamer) SetupRequest(req *http.Request) {
 	req.Body = m.GetReader()
 	req.Header.Add("Content-Type", m.ContentType)
@@ -152,13 +445,49 @@ func (m *MultipartStreamer) Boundary() string {
 	return m.bodyWriter.Boundary()
 }
 
-// Len calculates the byte size of the multipart content.
+// flushBuffer snapshots any header (or other small-part) bytes that
+// multipart.Writer has written into bodyBuffer since the last flush, and
+// turns them into a segment of their own. This keeps header bytes for part
+// N ordered ahead of part N's body reader even though bodyWriter only ever
+// writes into the one shared bodyBuffer.
+func (m *MultipartStreamer) flushBuffer() {
+	if m.bodyBuffer.Len() == 0 {
+		return
+	}
+
+	data := make([]byte, m.bodyBuffer.Len())
+	copy(data, m.bodyBuffer.Bytes())
+	m.bodyBuffer.Reset()
+
+	m.segments = append(m.segments, segment{reader: bytes.NewReader(data), length: int64(len(data))})
+}
+
+// Len calculates the byte size of the multipart content. It returns -1 if
+// any part (e.g. one written with WritePartEncoded or
+// WriteReaderUnknownSize) has an unknown length.
 func (m *MultipartStreamer) Len() int64 {
-	return m.contentLength + int64(m.bodyBuffer.Len()) + int64(m.closeBuffer.Len())
+	m.flushBuffer()
+
+	var total int64
+	for _, s := range m.segments {
+		if s.length < 0 {
+			return -1
+		}
+		total += s.length
+	}
+
+	return total + int64(m.closeBuffer.Len())
 }
 
 // GetReader gets an io.ReadCloser for passing to an http.Request.
 func (m *MultipartStreamer) GetReader() io.ReadCloser {
-	reader := io.MultiReader(m.bodyBuffer, m.reader, m.closeBuffer)
-	return ioutil.NopCloser(reader)
+	m.flushBuffer()
+
+	readers := make([]io.Reader, 0, len(m.segments)+1)
+	for _, s := range m.segments {
+		readers = append(readers, s.reader)
+	}
+	readers = append(readers, m.closeBuffer)
+
+	return ioutil.NopCloser(io.MultiReader(readers...))
 }
@@ -0,0 +1,339 @@
+package multipartstreamer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMultiplePartsInOrder checks that several streamed parts come out in
+// the order they were added, with an exact Len().
+func TestMultiplePartsInOrder(t *testing.T) {
+	first := "first file content"
+	second := "second file, a different length"
+
+	ms := New()
+	if err := ms.WriteReader("f1", "a.txt", int64(len(first)), strings.NewReader(first)); err != nil {
+		t.Fatalf("WriteReader(f1): %v", err)
+	}
+	if err := ms.WriteReader("f2", "b.txt", int64(len(second)), strings.NewReader(second)); err != nil {
+		t.Fatalf("WriteReader(f2): %v", err)
+	}
+
+	// Len must be read before GetReader's reader is drained: GetReader
+	// hands back the streamer's own closing-boundary buffer, which (like
+	// any bytes.Buffer used as a reader) empties as it's read.
+	wantLen := ms.Len()
+
+	body, err := io.ReadAll(ms.GetReader())
+	if err != nil {
+		t.Fatalf("reading streamer output: %v", err)
+	}
+	if got := int64(len(body)); got != wantLen {
+		t.Errorf("wire body is %d bytes, Len() reported %d", got, wantLen)
+	}
+
+	mr := multipart.NewReader(bytes.NewReader(body), ms.Boundary())
+
+	var names, contents []string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("NextPart: %v", err)
+		}
+
+		data, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatalf("reading part %q: %v", part.FormName(), err)
+		}
+
+		names = append(names, part.FormName())
+		contents = append(contents, string(data))
+	}
+
+	wantNames := []string{"f1", "f2"}
+	wantContents := []string{first, second}
+	for i := range wantNames {
+		if i >= len(names) || names[i] != wantNames[i] || contents[i] != wantContents[i] {
+			t.Fatalf("parts = %v / %v, want %v / %v", names, contents, wantNames, wantContents)
+		}
+	}
+}
+
+// TestWriteDirectory checks that a directory tree comes out as a part whose
+// Content-Type is multipart/mixed, holding a nested part per file with the
+// right Abspath, and that Len() is exact.
+func TestWriteDirectory(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), []byte("file a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "sub", "b.txt"), []byte("file b, nested deeper"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ms := New()
+	if err := ms.WriteDirectory("tree", root); err != nil {
+		t.Fatalf("WriteDirectory: %v", err)
+	}
+
+	wantLen := ms.Len()
+
+	body, err := io.ReadAll(ms.GetReader())
+	if err != nil {
+		t.Fatalf("reading streamer output: %v", err)
+	}
+	if got := int64(len(body)); got != wantLen {
+		t.Errorf("wire body is %d bytes, Len() reported %d", got, wantLen)
+	}
+
+	mr := multipart.NewReader(bytes.NewReader(body), ms.Boundary())
+
+	part, err := mr.NextPart()
+	if err != nil {
+		t.Fatalf("NextPart (tree): %v", err)
+	}
+	if part.FormName() != "tree" {
+		t.Errorf("top-level part name = %q, want %q", part.FormName(), "tree")
+	}
+	if got := part.Header.Get("Abspath"); got != "." {
+		t.Errorf("top-level Abspath = %q, want %q", got, ".")
+	}
+
+	gotFiles := map[string]string{}
+	if err := collectTreeFiles(part.Header, part, gotFiles); err != nil {
+		t.Fatalf("collectTreeFiles: %v", err)
+	}
+
+	want := map[string]string{
+		"a.txt":     "file a",
+		"sub/b.txt": "file b, nested deeper",
+	}
+	if len(gotFiles) != len(want) {
+		t.Fatalf("nested files = %v, want %v", gotFiles, want)
+	}
+	for abspath, content := range want {
+		if gotFiles[abspath] != content {
+			t.Errorf("file %q = %q, want %q", abspath, gotFiles[abspath], content)
+		}
+	}
+
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("expected only one top-level part, got another (err=%v)", err)
+	}
+}
+
+// collectTreeFiles walks a WriteDirectory part: if it's itself a directory
+// (multipart/mixed), it recurses into its nested parts; otherwise it's a
+// leaf file, recorded under its Abspath.
+func collectTreeFiles(header textproto.MIMEHeader, body io.Reader, files map[string]string) error {
+	_, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || params["boundary"] == "" {
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		files[header.Get("Abspath")] = string(data)
+		return nil
+	}
+
+	nested := multipart.NewReader(body, params["boundary"])
+	for {
+		np, err := nested.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := collectTreeFiles(np.Header, np, files); err != nil {
+			return err
+		}
+	}
+}
+
+// TestWritePartEncodedBase64 checks that a base64-encoded part decodes back
+// to the original content and that Len() stays exact, since base64 has a
+// deterministic output size.
+func TestWritePartEncodedBase64(t *testing.T) {
+	content := "encode me, please"
+
+	ms := New()
+	if err := ms.WritePartEncoded("file", "payload.b64", int64(len(content)), strings.NewReader(content), EncodingBase64, false, nil); err != nil {
+		t.Fatalf("WritePartEncoded: %v", err)
+	}
+
+	wantLen := ms.Len()
+	if wantLen < 0 {
+		t.Fatalf("Len() = %d, want an exact length for base64", wantLen)
+	}
+
+	body, err := io.ReadAll(ms.GetReader())
+	if err != nil {
+		t.Fatalf("reading streamer output: %v", err)
+	}
+	if got := int64(len(body)); got != wantLen {
+		t.Errorf("wire body is %d bytes, Len() reported %d", got, wantLen)
+	}
+
+	mr := multipart.NewReader(bytes.NewReader(body), ms.Boundary())
+	part, err := mr.NextPart()
+	if err != nil {
+		t.Fatalf("NextPart: %v", err)
+	}
+	if got := part.Header.Get("Content-Transfer-Encoding"); got != "base64" {
+		t.Errorf("Content-Transfer-Encoding = %q, want %q", got, "base64")
+	}
+
+	encoded, err := io.ReadAll(part)
+	if err != nil {
+		t.Fatalf("reading part: %v", err)
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(string(encoded))
+	if err != nil {
+		t.Fatalf("decoding base64 body: %v", err)
+	}
+	if string(decoded) != content {
+		t.Errorf("decoded content = %q, want %q", decoded, content)
+	}
+}
+
+// TestWritePartEncodedGzipUnknownLength checks that a non-precomputed gzip
+// part falls back to Len() == -1 (gzip's output size isn't predictable from
+// the input size), while still producing a part the server can gunzip.
+func TestWritePartEncodedGzipUnknownLength(t *testing.T) {
+	content := "some content to compress for the wire"
+
+	ms := New()
+	if err := ms.WritePartEncoded("file", "payload.gz", int64(len(content)), strings.NewReader(content), EncodingGzip, false, nil); err != nil {
+		t.Fatalf("WritePartEncoded: %v", err)
+	}
+
+	if got := ms.Len(); got != -1 {
+		t.Fatalf("Len() = %d, want -1 for a non-precomputed gzip part", got)
+	}
+
+	body, err := io.ReadAll(ms.GetReader())
+	if err != nil {
+		t.Fatalf("reading streamer output: %v", err)
+	}
+
+	mr := multipart.NewReader(bytes.NewReader(body), ms.Boundary())
+	part, err := mr.NextPart()
+	if err != nil {
+		t.Fatalf("NextPart: %v", err)
+	}
+	if got := part.Header.Get("Content-Encoding"); got != "gzip" {
+		t.Errorf("Content-Encoding = %q, want %q", got, "gzip")
+	}
+
+	gz, err := gzip.NewReader(part)
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	decoded, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("reading gunzipped body: %v", err)
+	}
+	if string(decoded) != content {
+		t.Errorf("gunzipped content = %q, want %q", decoded, content)
+	}
+}
+
+// TestWriteReaderUnknownSize streams an io.Pipe reader (unknown length, so
+// the request goes out chunked) and checks the server sees every part.
+func TestWriteReaderUnknownSize(t *testing.T) {
+	pr, pw := io.Pipe()
+
+	go func() {
+		pw.Write([]byte("streamed over a pipe, no Content-Length known up front"))
+		pw.Close()
+	}()
+
+	ms := New()
+	if err := ms.WriteFields(map[string]string{"title": "pipe upload"}); err != nil {
+		t.Fatalf("WriteFields: %v", err)
+	}
+	if err := ms.WriteReaderUnknownSize("file", "stream.bin", pr); err != nil {
+		t.Fatalf("WriteReaderUnknownSize: %v", err)
+	}
+
+	if got := ms.Len(); got != -1 {
+		t.Fatalf("Len() = %d, want -1 for unknown-size part", got)
+	}
+
+	var gotFields map[string]string
+	var gotFile []byte
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength != -1 {
+			t.Errorf("server saw Content-Length = %d, want -1 (chunked)", r.ContentLength)
+		}
+
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil {
+			t.Fatalf("ParseMediaType: %v", err)
+		}
+
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		gotFields = map[string]string{}
+
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("NextPart: %v", err)
+			}
+
+			data, err := io.ReadAll(part)
+			if err != nil {
+				t.Fatalf("reading part %q: %v", part.FormName(), err)
+			}
+
+			if part.FormName() == "file" {
+				gotFile = data
+			} else {
+				gotFields[part.FormName()] = string(data)
+			}
+		}
+	}))
+	defer server.Close()
+
+	req, err := http.NewRequest("POST", server.URL, nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %v", err)
+	}
+	ms.SetupRequest(req)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	resp.Body.Close()
+
+	if gotFields["title"] != "pipe upload" {
+		t.Errorf("field %q = %q, want %q", "title", gotFields["title"], "pipe upload")
+	}
+	if string(gotFile) != "streamed over a pipe, no Content-Length known up front" {
+		t.Errorf("file part = %q, want the piped content", gotFile)
+	}
+}
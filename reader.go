@@ -0,0 +1,185 @@
+package multipartstreamer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+)
+
+// Reader is the inverse of MultipartStreamer: it parses a multipart body
+// one part at a time, handing each one to the caller as soon as its headers
+// are available, so a caller can stream a part straight to disk, S3, a
+// hash, etc. without ever buffering the whole body (unlike
+// mime/multipart.Reader.ReadForm, which materializes the entire form before
+// returning).
+type Reader struct {
+	mr *multipart.Reader
+}
+
+// NewReader builds a Reader that parses r as a multipart body delimited by
+// boundary.
+func NewReader(r io.Reader, boundary string) *Reader {
+	return &Reader{mr: multipart.NewReader(r, boundary)}
+}
+
+// NewReaderFromContentType builds a Reader from r and a full Content-Type
+// header value (as set by MultipartStreamer.SetupRequest), extracting the
+// boundary parameter.
+func NewReaderFromContentType(r io.Reader, contentType string) (*Reader, error) {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	boundary, ok := params["boundary"]
+	if !ok {
+		return nil, fmt.Errorf("multipartstreamer: content type %q has no boundary parameter", contentType)
+	}
+
+	return NewReader(r, boundary), nil
+}
+
+// Part is one part of a multipart body: its headers, plus its body as a
+// lazily-read io.Reader.
+type Part struct {
+	*multipart.Part
+}
+
+// Abspath returns the "Abspath" header written by MultipartStreamer's
+// WriteDirectory, or "" if this part didn't carry one.
+func (p *Part) Abspath() string {
+	return p.Header.Get("Abspath")
+}
+
+// Next returns the next part of the body, or io.EOF once there are no more.
+// Any unread rest of the previous part's body is discarded, same as
+// multipart.Reader.NextPart.
+func (r *Reader) Next() (*Part, error) {
+	p, err := r.mr.NextPart()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Part{Part: p}, nil
+}
+
+// FileHeader describes a file part saved to disk by SaveToDir.
+type FileHeader struct {
+	Filename string
+	Header   textproto.MIMEHeader
+	Size     int64
+
+	tmpfile string
+}
+
+// Open opens the saved file for reading. The caller must Close it.
+func (fh *FileHeader) Open() (io.ReadCloser, error) {
+	return os.Open(fh.tmpfile)
+}
+
+// Form is the result of SaveToDir: form field values kept in memory, and
+// file parts spilled to disk, mirroring the shape of multipart.Form.
+type Form struct {
+	Value map[string][]string
+	File  map[string][]*FileHeader
+}
+
+// RemoveAll removes every temporary file created by SaveToDir. Callers
+// should defer it once they're done with the Form, same as
+// multipart.Form.RemoveAll.
+func (f *Form) RemoveAll() error {
+	var firstErr error
+
+	for _, headers := range f.File {
+		for _, fh := range headers {
+			if err := os.Remove(fh.tmpfile); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	return firstErr
+}
+
+// SaveToDir reads every part of the body, keeping form values (up to
+// maxMemory bytes total) in memory and spilling every file part straight to
+// a temp file in dir, regardless of size. This reproduces the semantics
+// callers expect from mime/multipart's maxMemory parameter, but a 10GB file
+// part never touches that memory budget: it streams directly to disk as it
+// arrives.
+func (r *Reader) SaveToDir(dir string, maxMemory int64) (*Form, error) {
+	form := &Form{
+		Value: make(map[string][]string),
+		File:  make(map[string][]*FileHeader),
+	}
+
+	var memUsed int64
+
+	for {
+		part, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			form.RemoveAll()
+			return nil, err
+		}
+
+		name := part.FormName()
+		if name == "" {
+			continue
+		}
+
+		if filename := part.FileName(); filename != "" {
+			fh, err := r.saveFilePart(dir, filename, part)
+			if err != nil {
+				form.RemoveAll()
+				return nil, err
+			}
+			form.File[name] = append(form.File[name], fh)
+			continue
+		}
+
+		var buf bytes.Buffer
+		n, err := io.CopyN(&buf, part, maxMemory-memUsed+1)
+		if err != nil && err != io.EOF {
+			form.RemoveAll()
+			return nil, err
+		}
+		if n > maxMemory-memUsed {
+			form.RemoveAll()
+			return nil, fmt.Errorf("multipartstreamer: form value %q exceeds maxMemory (%d bytes)", name, maxMemory)
+		}
+
+		memUsed += n
+		form.Value[name] = append(form.Value[name], buf.String())
+	}
+
+	return form, nil
+}
+
+func (r *Reader) saveFilePart(dir, filename string, part *Part) (*FileHeader, error) {
+	tmp, err := ioutil.TempFile(dir, "multipartstreamer-")
+	if err != nil {
+		return nil, err
+	}
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, part)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	return &FileHeader{
+		Filename: filename,
+		Header:   part.Header,
+		Size:     size,
+		tmpfile:  tmp.Name(),
+	}, nil
+}
@@ -0,0 +1,71 @@
+package multipartstreamer
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+// TestReaderSaveToDir round-trips a MultipartStreamer body through Reader
+// and checks that form values and a file part both come back intact, with
+// the file spilled to disk.
+func TestReaderSaveToDir(t *testing.T) {
+	ms := New()
+	if err := ms.WriteFields(map[string]string{"title": "round trip"}); err != nil {
+		t.Fatalf("WriteFields: %v", err)
+	}
+	content := []byte("file part body")
+	if err := ms.WriteReader("file", "payload.bin", int64(len(content)), bytes.NewReader(content)); err != nil {
+		t.Fatalf("WriteReader: %v", err)
+	}
+
+	body, err := io.ReadAll(ms.GetReader())
+	if err != nil {
+		t.Fatalf("reading streamer output: %v", err)
+	}
+
+	dir := t.TempDir()
+	r := NewReader(bytes.NewReader(body), ms.Boundary())
+
+	form, err := r.SaveToDir(dir, 1<<20)
+	if err != nil {
+		t.Fatalf("SaveToDir: %v", err)
+	}
+	defer form.RemoveAll()
+
+	if got := form.Value["title"]; len(got) != 1 || got[0] != "round trip" {
+		t.Errorf("Value[title] = %v, want [\"round trip\"]", got)
+	}
+
+	files := form.File["file"]
+	if len(files) != 1 {
+		t.Fatalf("File[file] has %d entries, want 1", len(files))
+	}
+
+	fh := files[0]
+	if fh.Filename != "payload.bin" {
+		t.Errorf("Filename = %q, want %q", fh.Filename, "payload.bin")
+	}
+	if fh.Size != int64(len(content)) {
+		t.Errorf("Size = %d, want %d", fh.Size, len(content))
+	}
+
+	f, err := fh.Open()
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("reading saved file: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("saved file content = %q, want %q", got, content)
+	}
+
+	if _, err := os.Stat(fh.tmpfile); err != nil {
+		t.Errorf("saved file %q should exist on disk: %v", fh.tmpfile, err)
+	}
+}